@@ -0,0 +1,226 @@
+// Package cmd tokenizes and parses chat commands using a grammar derived
+// from struct tags, replacing ad-hoc regular expressions. A command is
+// declared as a Go struct, e.g.:
+//
+//	type UpdateField struct {
+//		Field string `opt:"field"`
+//		Value string `opt:"value" rest:"true"`
+//	}
+//
+// Register it once, then Parse raw message text against it. `rest:"true"`
+// marks the field that should greedily consume the remainder of the line
+// (so values may contain spaces, e.g. nicknames) instead of stopping at the
+// next token.
+package cmd
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Grammar is a parsed description of a command struct's fields, built once
+// at Register time via reflection.
+type Grammar struct {
+	Name      string
+	protoType reflect.Type
+	fields    []fieldSpec
+}
+
+type fieldSpec struct {
+	structIndex int
+	opt         string
+	rest        bool
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]*Grammar{}
+)
+
+// Register derives a Grammar from proto's `opt` struct tags and makes it
+// available to Parse and Help under name. proto must be a struct value (not
+// a pointer); its fields are read, never mutated.
+func Register(name string, proto interface{}) (*Grammar, error) {
+	t := reflect.TypeOf(proto)
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("cmd: Register(%q) requires a struct value", name)
+	}
+
+	g := &Grammar{Name: name, protoType: t}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		opt, ok := f.Tag.Lookup("opt")
+		if !ok {
+			continue
+		}
+		g.fields = append(g.fields, fieldSpec{
+			structIndex: i,
+			opt:         opt,
+			rest:        f.Tag.Get("rest") == "true",
+		})
+	}
+
+	registryMu.Lock()
+	registry[name] = g
+	registryMu.Unlock()
+	return g, nil
+}
+
+// Lookup returns the Grammar registered under name, if any.
+func Lookup(name string) (*Grammar, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	g, ok := registry[name]
+	return g, ok
+}
+
+// Tokenize splits input on spaces and tabs, honouring single and double quoted
+// spans (so a quoted value may contain spaces) and backslash-escaping of the
+// quote character and backslash itself. Case is always preserved - callers
+// that want case-insensitive matching (command names) should lower-case
+// only the token they compare, not the whole line, so values like emails
+// survive untouched.
+func Tokenize(input string) ([]string, error) {
+	var tokens []string
+	var cur strings.Builder
+	inToken := false
+	var quote rune
+
+	flush := func() {
+		if inToken {
+			tokens = append(tokens, cur.String())
+			cur.Reset()
+			inToken = false
+		}
+	}
+
+	runes := []rune(input)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote != 0:
+			if r == '\\' && i+1 < len(runes) && (runes[i+1] == quote || runes[i+1] == '\\') {
+				cur.WriteRune(runes[i+1])
+				i++
+				continue
+			}
+			if r == quote {
+				quote = 0
+				continue
+			}
+			cur.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+			inToken = true
+		case r == ' ' || r == '\t':
+			flush()
+		default:
+			inToken = true
+			cur.WriteRune(r)
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("cmd: unterminated %q quote", quote)
+	}
+	flush()
+	return tokens, nil
+}
+
+// Command is a parsed command: the matched grammar name plus the value
+// populated from the struct it was registered with.
+type Command struct {
+	Name  string
+	Value interface{}
+}
+
+// Parse tokenizes input and matches it against the grammar registered under
+// name. Optional args may be given as
+// `opt:value` or `opt: value`; the last declared field may instead be
+// tagged `rest:"true"` to soak up every remaining token verbatim (joined
+// back with single spaces), which is how nicknames with spaces and
+// un-lowercased emails are supported.
+func Parse(name string, input string) (*Command, error) {
+	g, ok := Lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("cmd: no grammar registered for %q", name)
+	}
+
+	tokens, err := Tokenize(input)
+	if err != nil {
+		return nil, err
+	}
+
+	v := reflect.New(g.protoType).Elem()
+	consumed := make([]bool, len(tokens))
+
+	for _, fs := range g.fields {
+		if fs.rest {
+			continue
+		}
+		for i, tok := range tokens {
+			if consumed[i] {
+				continue
+			}
+			key, val, ok := splitOptToken(tok)
+			if !ok || !strings.EqualFold(key, fs.opt) {
+				continue
+			}
+			consumed[i] = true
+			if val == "" && i+1 < len(tokens) && !consumed[i+1] {
+				val = tokens[i+1]
+				consumed[i+1] = true
+			}
+			v.Field(fs.structIndex).SetString(val)
+			break
+		}
+	}
+
+	for _, fs := range g.fields {
+		if !fs.rest {
+			continue
+		}
+		var remaining []string
+		for i, tok := range tokens {
+			if !consumed[i] {
+				remaining = append(remaining, tok)
+			}
+		}
+		v.Field(fs.structIndex).SetString(strings.Join(remaining, " "))
+	}
+
+	return &Command{Name: g.Name, Value: v.Interface()}, nil
+}
+
+// splitOptToken splits a "field:value" token. The tokenizer never merges
+// tokens across whitespace, so "field: value" arrives as "field:" with an
+// empty val, and Parse then takes the following token as the value. A
+// bare-word token with no colon is returned with ok set to false, meaning
+// "treat me as part of rest".
+func splitOptToken(tok string) (key, val string, ok bool) {
+	idx := strings.Index(tok, ":")
+	if idx < 0 {
+		return "", "", false
+	}
+	return tok[:idx], tok[idx+1:], true
+}
+
+// Help derives usage text for a registered command from its opt tags, so
+// documentation can't drift out of sync with the grammar the way hand
+// written usage strings did.
+func Help(name string) string {
+	g, ok := Lookup(name)
+	if !ok {
+		return ""
+	}
+	var parts []string
+	for _, fs := range g.fields {
+		if fs.rest {
+			parts = append(parts, "<"+fs.opt+" ...>")
+		} else {
+			parts = append(parts, fs.opt+": "+"<"+fs.opt+">")
+		}
+	}
+	return g.Name + ": " + strings.Join(parts, " ")
+}
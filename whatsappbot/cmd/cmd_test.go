@@ -0,0 +1,59 @@
+package cmd
+
+import "testing"
+
+type fieldValueFixture struct {
+	Value string `opt:"value" rest:"true"`
+}
+
+func TestTokenizePreservesQuotedSpacesAndCase(t *testing.T) {
+	tokens, err := Tokenize(`"Jane Doe" Jane@Example.com`)
+	if err != nil {
+		t.Fatalf("Tokenize returned error: %v", err)
+	}
+	want := []string{"Jane Doe", "Jane@Example.com"}
+	if len(tokens) != len(want) {
+		t.Fatalf("got %d tokens %v, want %d", len(tokens), tokens, len(want))
+	}
+	for i := range want {
+		if tokens[i] != want[i] {
+			t.Errorf("token %d = %q, want %q", i, tokens[i], want[i])
+		}
+	}
+}
+
+func TestTokenizeUnterminatedQuote(t *testing.T) {
+	if _, err := Tokenize(`"unterminated`); err == nil {
+		t.Fatal("expected an error for an unterminated quote")
+	}
+}
+
+func TestParseRestFieldKeepsSpacesAndCase(t *testing.T) {
+	if _, err := Register("fieldvaluefixture", fieldValueFixture{}); err != nil {
+		t.Fatalf("Register returned error: %v", err)
+	}
+
+	parsed, err := Parse("fieldvaluefixture", "Jane Doe")
+	if err != nil {
+		t.Fatalf("Parse returned error: %v", err)
+	}
+	got := parsed.Value.(fieldValueFixture).Value
+	if got != "Jane Doe" {
+		t.Errorf("Value = %q, want %q (nicknames must keep spaces)", got, "Jane Doe")
+	}
+
+	parsed, err = Parse("fieldvaluefixture", "Jane@Example.com")
+	if err != nil {
+		t.Fatalf("Parse returned error: %v", err)
+	}
+	got = parsed.Value.(fieldValueFixture).Value
+	if got != "Jane@Example.com" {
+		t.Errorf("Value = %q, want %q (emails must keep their case)", got, "Jane@Example.com")
+	}
+}
+
+func TestParseUnknownGrammar(t *testing.T) {
+	if _, err := Parse("no-such-grammar", "anything"); err == nil {
+		t.Fatal("expected an error for an unregistered grammar")
+	}
+}
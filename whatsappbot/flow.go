@@ -0,0 +1,315 @@
+package whatsappbot
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FlowState is the persisted progress of a multi-turn conversation such as a
+// checkout wizard. Scratch holds whatever answers the flow has collected so
+// far, keyed by whatever names the FlowHandler chooses.
+type FlowState struct {
+	UserJID   string
+	FlowName  string
+	Step      int
+	Scratch   map[string]string
+	ExpiresAt time.Time
+}
+
+// FlowContext carries the request-scoped state (the DB handle, the sender's
+// UserInfo/CurrentOrder, checkout URLs) a flow needs to act on the world -
+// e.g. to actually run BeginCheckout once the user confirms - without
+// threading it through FlowState, which is just the persisted step/scratch.
+type FlowContext struct {
+	DB           *sql.DB
+	UserInfo     UserInfo
+	CurrentOrder CustomerOrder
+	CheckoutUrls CheckoutInfo
+	IsAutoInc    bool
+}
+
+// FlowHandler drives one named flow. Prompt returns the text to send for the
+// current step; Accept consumes the user's reply to that prompt and reports
+// which step to move to next. Returning the same step number repeats the
+// prompt (e.g. on invalid input); a handler signals completion by returning
+// a step of FlowDone.
+type FlowHandler interface {
+	Prompt(state FlowState) string
+	Accept(state FlowState, input string, fctx FlowContext) (nextStep int, cmds []Command, err error)
+}
+
+// FlowDone is the step value a FlowHandler returns from Accept to signal the
+// flow has finished and its state should be cleared.
+const FlowDone = -1
+
+// flowCancelWord lets a user bail out of any flow early.
+const flowCancelWord = "cancel"
+
+const flowTimeout = 15 * time.Minute
+
+var (
+	flowRegistryMu sync.RWMutex
+	flowRegistry   = map[string]FlowHandler{}
+)
+
+// RegisterFlow makes a FlowHandler reachable by the name users type to start
+// it, e.g. RegisterFlow("checkout", checkoutFlow{}).
+func RegisterFlow(name string, handler FlowHandler) {
+	flowRegistryMu.Lock()
+	defer flowRegistryMu.Unlock()
+	flowRegistry[name] = handler
+}
+
+func lookupFlow(name string) (FlowHandler, bool) {
+	flowRegistryMu.RLock()
+	defer flowRegistryMu.RUnlock()
+	h, ok := flowRegistry[name]
+	return h, ok
+}
+
+// StartFlow begins a registered flow for a user and returns its first
+// prompt. Callers are expected to persist the resulting state via Save.
+func StartFlow(name, userJID string) (FlowState, string, error) {
+	handler, ok := lookupFlow(name)
+	if !ok {
+		return FlowState{}, "", fmt.Errorf("no flow registered under name: %s", name)
+	}
+	state := FlowState{
+		UserJID:   userJID,
+		FlowName:  name,
+		Step:      0,
+		Scratch:   map[string]string{},
+		ExpiresAt: time.Now().Add(flowTimeout),
+	}
+	return state, handler.Prompt(state), nil
+}
+
+// AdvanceFlow routes a reply to the flow's Accept and returns the prompt for
+// the resulting step, along with any Commands the flow emitted (the same
+// Command values the regex/tokenizer-driven dispatcher already consumes).
+// ok is false once the flow is finished or cancelled, in which case callers
+// should delete the persisted state instead of saving it.
+func AdvanceFlow(state FlowState, input string, fctx FlowContext) (next FlowState, prompt string, cmds []Command, ok bool, err error) {
+	if strings.EqualFold(strings.TrimSpace(input), flowCancelWord) {
+		return state, "Okay, cancelled.", nil, false, nil
+	}
+
+	handler, found := lookupFlow(state.FlowName)
+	if !found {
+		return state, "", nil, false, fmt.Errorf("no flow registered under name: %s", state.FlowName)
+	}
+
+	nextStep, cmds, err := handler.Accept(state, input, fctx)
+	if err != nil {
+		return state, "", nil, true, err
+	}
+	if nextStep == FlowDone {
+		return state, "", cmds, false, nil
+	}
+
+	state.Step = nextStep
+	state.ExpiresAt = time.Now().Add(flowTimeout)
+	return state, handler.Prompt(state), cmds, true, nil
+}
+
+// LoadActiveFlow returns the in-progress flow state for a user, if any.
+// An expired flow is treated as absent and deleted.
+func LoadActiveFlow(db *sql.DB, userJID string) (*FlowState, error) {
+	row := db.QueryRow(`SELECT flow_name, step, scratch, expires_at FROM flow_state WHERE user_jid = $1`, userJID)
+
+	var state FlowState
+	state.UserJID = userJID
+	var scratch string
+	if err := row.Scan(&state.FlowName, &state.Step, &scratch, &state.ExpiresAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unhandled error loading flow state: %v", err)
+	}
+
+	if time.Now().After(state.ExpiresAt) {
+		if err := DeleteFlowState(db, userJID); err != nil {
+			return nil, fmt.Errorf("unhandled error deleting expired flow state: %v", err)
+		}
+		return nil, nil
+	}
+
+	state.Scratch = decodeScratch(scratch)
+	return &state, nil
+}
+
+// Save upserts a flow's state so it survives between messages.
+func (fs FlowState) Save(db *sql.DB) error {
+	_, err := db.Exec(`
+		INSERT INTO flow_state (user_jid, flow_name, step, scratch, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_jid) DO UPDATE
+		SET flow_name = EXCLUDED.flow_name, step = EXCLUDED.step, scratch = EXCLUDED.scratch, expires_at = EXCLUDED.expires_at`,
+		fs.UserJID, fs.FlowName, fs.Step, encodeScratch(fs.Scratch), fs.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("unhandled error saving flow state: %v", err)
+	}
+	return nil
+}
+
+// DeleteFlowState clears any in-progress flow for a user, e.g. on
+// completion, cancellation or timeout.
+func DeleteFlowState(db *sql.DB, userJID string) error {
+	_, err := db.Exec(`DELETE FROM flow_state WHERE user_jid = $1`, userJID)
+	if err != nil {
+		return fmt.Errorf("unhandled error deleting flow state: %v", err)
+	}
+	return nil
+}
+
+const (
+	checkoutStepEmail         = 0
+	checkoutStepConfirm       = 1
+	checkoutStepPaymentMethod = 2
+)
+
+// checkoutPaymentMethods maps the numbered choices offered at
+// checkoutStepPaymentMethod to the PaymentProvider name they check out
+// through.
+var checkoutPaymentMethods = map[string]string{
+	"1": "payfast",    // Card
+	"2": "manual-eft", // EFT
+}
+
+// checkoutFlow walks a user through confirming their email and cart, then
+// picking a payment method, before actually checking out - step by step,
+// instead of requiring the whole order in one message.
+type checkoutFlow struct{}
+
+func (checkoutFlow) Prompt(state FlowState) string {
+	switch state.Step {
+	case checkoutStepEmail:
+		return "What's your email?"
+	case checkoutStepConfirm:
+		return "Confirm cart: yes/no"
+	case checkoutStepPaymentMethod:
+		return "Choose payment method: 1) Card 2) EFT"
+	default:
+		return ""
+	}
+}
+
+func (checkoutFlow) Accept(state FlowState, input string, fctx FlowContext) (int, []Command, error) {
+	input = strings.TrimSpace(input)
+	switch state.Step {
+	case checkoutStepEmail:
+		state.Scratch["email"] = input
+		return checkoutStepConfirm, nil, nil
+
+	case checkoutStepConfirm:
+		if !strings.EqualFold(input, "yes") {
+			cmds := []Command{QuestionCommand{CommandData: CommandData{Name: "checkout-cancelled", Text: "Okay, cancelled."}}}
+			return FlowDone, cmds, nil
+		}
+		return checkoutStepPaymentMethod, nil, nil
+
+	case checkoutStepPaymentMethod:
+		provider, ok := checkoutPaymentMethods[input]
+		if !ok {
+			return checkoutStepPaymentMethod, nil, nil
+		}
+
+		// Apply the email collected at checkoutStepEmail before building the
+		// checkout payload, so the payment provider gets the address the
+		// user just typed rather than whatever was on file before.
+		updateEmail := UpdateUserInfoCommand{CommandData: CommandData{Name: "update email", Text: state.Scratch["email"]}}
+		if err := updateEmail.Execute(fctx.DB, fctx.UserInfo, fctx.IsAutoInc); err != nil {
+			log.Println(err.Error())
+		}
+		fctx.UserInfo.Email.String = state.Scratch["email"]
+		fctx.UserInfo.Email.Valid = true
+
+		checkoutUrls := fctx.CheckoutUrls
+		checkoutUrls.Provider = provider
+		checkoutText := BeginCheckout(fctx.DB, fctx.UserInfo, fctx.CurrentOrder, checkoutUrls, fctx.IsAutoInc)
+
+		cmds := []Command{
+			QuestionCommand{CommandData: CommandData{Name: "checkoutnow", Text: checkoutText}},
+		}
+		return FlowDone, cmds, nil
+
+	default:
+		return FlowDone, nil, fmt.Errorf("checkout flow: unknown step %d", state.Step)
+	}
+}
+
+func init() {
+	RegisterFlow("checkout", checkoutFlow{})
+}
+
+// continueFlow advances an active flow with the sender's raw message body,
+// persists (or clears) the resulting state, and sends whatever prompt or
+// command output that produced.
+func (c *ChatClient) continueFlow(state FlowState, convo ConversationContext, db *sql.DB, checkoutUrls CheckoutInfo, isAutoInc bool) {
+	fctx := FlowContext{
+		DB:           db,
+		UserInfo:     convo.UserInfo,
+		CurrentOrder: convo.CurrentOrder,
+		CheckoutUrls: checkoutUrls,
+		IsAutoInc:    isAutoInc,
+	}
+	next, prompt, cmds, ok, err := AdvanceFlow(state, convo.MessageBody, fctx)
+	if err != nil {
+		log.Println(err.Error())
+		prompt = tr(convo.UserInfo, "unhandledCommandException")
+		ok = false
+	}
+
+	if !ok {
+		if err := DeleteFlowState(db, state.UserJID); err != nil {
+			log.Println(err.Error())
+		}
+	} else if err := next.Save(db); err != nil {
+		log.Println(err.Error())
+	}
+
+	if len(cmds) != 0 {
+		if res := CommandCollection(cmds).ProcessCommands(convo.UserInfo, db, isAutoInc); res != "" {
+			if prompt != "" {
+				prompt += "\n\n"
+			}
+			prompt += res
+		}
+	}
+
+	if err := c.SendMessage(convo.UserInfo.CellNumber, prompt); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// encodeScratch/decodeScratch use a simple "key=value" line format rather
+// than pulling in a JSON dependency just for a handful of short answers.
+func encodeScratch(scratch map[string]string) string {
+	var b strings.Builder
+	for k, v := range scratch {
+		b.WriteString(k)
+		b.WriteString("=")
+		b.WriteString(strings.ReplaceAll(v, "\n", " "))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func decodeScratch(encoded string) map[string]string {
+	scratch := map[string]string{}
+	for _, line := range strings.Split(encoded, "\n") {
+		if line == "" {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		scratch[kv[0]] = kv[1]
+	}
+	return scratch
+}
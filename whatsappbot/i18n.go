@@ -0,0 +1,84 @@
+package whatsappbot
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+// defaultLocale is used whenever a user's locale is unset or a key is
+// missing from their locale's catalog.
+const defaultLocale = "en"
+
+// catalog maps locale -> message key -> format string. Format strings use
+// ordinary fmt verbs (%s, %d, ...), so tr is just fmt.Sprintf with a
+// catalog lookup in front of it.
+var catalog = map[string]map[string]string{}
+
+func init() {
+	entries, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		panic(fmt.Sprintf("whatsappbot: failed to read embedded locales: %v", err))
+	}
+	for _, entry := range entries {
+		locale := strings.TrimSuffix(entry.Name(), ".json")
+		data, err := localeFiles.ReadFile("locales/" + entry.Name())
+		if err != nil {
+			panic(fmt.Sprintf("whatsappbot: failed to read embedded locale %s: %v", locale, err))
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(data, &messages); err != nil {
+			panic(fmt.Sprintf("whatsappbot: failed to parse embedded locale %s: %v", locale, err))
+		}
+		catalog[locale] = messages
+	}
+}
+
+// tr resolves a message catalog key for ui's locale, falling back to
+// defaultLocale when the user's locale is unset or doesn't have that key,
+// and finally to key itself so a missing translation never surfaces a blank
+// message. args are applied with fmt.Sprintf.
+func tr(ui UserInfo, key string, args ...any) string {
+	template, ok := catalog[ui.Locale][key]
+	if !ok {
+		template, ok = catalog[defaultLocale][key]
+	}
+	if !ok {
+		template = key
+	}
+	if len(args) == 0 {
+		return template
+	}
+	return fmt.Sprintf(template, args...)
+}
+
+// countryLocales maps a phone number's leading dialing code to the locale
+// new users should default to. Anything unrecognised falls back to English.
+var countryLocales = map[string]string{
+	"27": "af", // South Africa
+}
+
+// DetectLocale guesses a new contact's locale from their WhatsApp JID's
+// country dialing code. It's a first guess only - users can correct it with
+// "update locale: xx".
+func DetectLocale(cellNumber string) string {
+	for code, locale := range countryLocales {
+		if strings.HasPrefix(cellNumber, code) {
+			return locale
+		}
+	}
+	return defaultLocale
+}
+
+// Pluralize picks singular or plural based on n, matching the simple
+// one/many split used throughout order summaries ("1 gram" vs "12 grams").
+func Pluralize(n int, singular, plural string) string {
+	if n == 1 {
+		return singular
+	}
+	return plural
+}
@@ -0,0 +1,207 @@
+package whatsappbot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/febriliankr/whatsapp-cloud-api"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// Button is one tappable reply option in a WhatsApp buttons message.
+type Button struct {
+	ID    string
+	Title string
+}
+
+// ListRow is a single selectable row within a ListSection.
+type ListRow struct {
+	ID          string
+	Title       string
+	Description string
+}
+
+// ListSection groups ListRows under a heading in a WhatsApp list message.
+type ListSection struct {
+	Title string
+	Rows  []ListRow
+}
+
+// InteractiveSender is implemented by transports that can render tappable
+// buttons and lists rather than plain conversation text. Transports that
+// don't (a bare CLI backend, say) simply don't satisfy it, and
+// ChatClient.SendButtons/SendList report that cleanly instead of panicking
+// on a failed type assertion.
+type InteractiveSender interface {
+	SendButtons(destinationNum, body string, buttons []Button) error
+	SendList(destinationNum, body string, sections []ListSection) error
+}
+
+// SendButtons sends a buttons message if the underlying transport supports
+// it, falling back to an error the caller can use to degrade to plain text.
+func (c *ChatClient) SendButtons(destinationNum, body string, buttons []Button) error {
+	sender, ok := c.Transport.(InteractiveSender)
+	if !ok {
+		return errors.New("transport does not support interactive messages")
+	}
+	return sender.SendButtons(destinationNum, body, buttons)
+}
+
+// SendList sends a list message if the underlying transport supports it.
+func (c *ChatClient) SendList(destinationNum, body string, sections []ListSection) error {
+	sender, ok := c.Transport.(InteractiveSender)
+	if !ok {
+		return errors.New("transport does not support interactive messages")
+	}
+	return sender.SendList(destinationNum, body, sections)
+}
+
+func (t *whatsmeowTransport) SendButtons(destinationNum, body string, buttons []Button) error {
+	waButtons := make([]*waProto.ButtonsMessage_Button, len(buttons))
+	for i, b := range buttons {
+		waButtons[i] = &waProto.ButtonsMessage_Button{
+			ButtonId: proto.String(b.ID),
+			ButtonText: &waProto.ButtonsMessage_Button_ButtonText{
+				DisplayText: proto.String(b.Title),
+			},
+			Type: waProto.ButtonsMessage_Button_RESPONSE.Enum(),
+		}
+	}
+	jId := types.NewJID(destinationNum, whatsAppServer)
+	_, err := t.client.SendMessage(context.Background(), jId, &waProto.Message{
+		ButtonsMessage: &waProto.ButtonsMessage{
+			ContentText: proto.String(body),
+			Buttons:     waButtons,
+			HeaderType:  waProto.ButtonsMessage_EMPTY.Enum(),
+		},
+	})
+	return err
+}
+
+func (t *whatsmeowTransport) SendList(destinationNum, body string, sections []ListSection) error {
+	waSections := make([]*waProto.ListMessage_Section, len(sections))
+	for i, s := range sections {
+		rows := make([]*waProto.ListMessage_Row, len(s.Rows))
+		for j, r := range s.Rows {
+			rows[j] = &waProto.ListMessage_Row{
+				RowId:       proto.String(r.ID),
+				Title:       proto.String(r.Title),
+				Description: proto.String(r.Description),
+			}
+		}
+		waSections[i] = &waProto.ListMessage_Section{Title: proto.String(s.Title), Rows: rows}
+	}
+	jId := types.NewJID(destinationNum, whatsAppServer)
+	_, err := t.client.SendMessage(context.Background(), jId, &waProto.Message{
+		ListMessage: &waProto.ListMessage{
+			Description: proto.String(body),
+			ListType:    waProto.ListMessage_SINGLE_SELECT.Enum(),
+			Sections:    waSections,
+		},
+	})
+	return err
+}
+
+// SendButtons on the Cloud API backend maps to Meta's interactive button
+// template, which supports at most three reply buttons.
+func (t *cloudAPITransport) SendButtons(destinationNum, body string, buttons []Button) error {
+	if len(buttons) > 3 {
+		return fmt.Errorf("cloud-api transport: interactive buttons support at most 3 options, got %d", len(buttons))
+	}
+	waButtons := make([]whatsapp.Button, len(buttons))
+	for i, b := range buttons {
+		waButtons[i] = whatsapp.Button{ID: b.ID, Title: b.Title}
+	}
+	_, err := t.client.SendButtons(destinationNum, body, waButtons)
+	return err
+}
+
+// SendList on the Cloud API backend maps to Meta's interactive list
+// template.
+func (t *cloudAPITransport) SendList(destinationNum, body string, sections []ListSection) error {
+	waSections := make([]whatsapp.ListSection, len(sections))
+	for i, s := range sections {
+		rows := make([]whatsapp.ListRow, len(s.Rows))
+		for j, r := range s.Rows {
+			rows[j] = whatsapp.ListRow{ID: r.ID, Title: r.Title, Description: r.Description}
+		}
+		waSections[i] = whatsapp.ListSection{Title: s.Title, Rows: rows}
+	}
+	_, err := t.client.SendList(destinationNum, body, waSections)
+	return err
+}
+
+// mainMenuList is the main menu rendered as a tappable list instead of the
+// plain-text mainMenuText, for transports whose Capabilities() report
+// SupportsButtons.
+func mainMenuList() []ListSection {
+	return []ListSection{{
+		Title: "Main Menu",
+		Rows: []ListRow{
+			{ID: "fr.prlist?", Title: "Price list", Description: "Prints the Flying Rasta price list"},
+			{ID: "menu?", Title: "Menu", Description: "Prints this menu"},
+			{ID: "userinfo?", Title: "User info", Description: "Prints your user info"},
+			{ID: "currentorder?", Title: "Current order", Description: "Prints your pending order"},
+			{ID: "checkoutnow?", Title: "Checkout", Description: "Get a payment link for your basket"},
+		},
+	}}
+}
+
+// trySendMenu sends the main menu as a tappable list when the transport
+// supports interactive messages, reporting whether it did so. Callers
+// should fall back to the plain-text mainMenuText when it returns false.
+func (c *ChatClient) trySendMenu(ui UserInfo) bool {
+	if c.Transport == nil || !c.Transport.Capabilities().SupportsButtons {
+		return false
+	}
+	if err := c.SendList(ui.CellNumber, mainMenuText(ui), mainMenuList()); err != nil {
+		return false
+	}
+	return true
+}
+
+// priceListText is the plain-text price list response: the same Text a
+// typed "fr.prlist?" produces, and the sentinel chatBegin checks against to
+// decide whether to retry it as a tappable list instead.
+func priceListText(ui UserInfo) string {
+	return tr(ui, "prclstPreamble", updateOrderCommand, fullOrderExample) + "\n\n" + PriceListAsAString()
+}
+
+// priceListSections turns PriceListAsAString's numbered lines into list
+// rows the user can tap instead of typing "update order: N:1" by hand. Each
+// row's ID is the update-order command for one unit of that item, so
+// tapping a product adds it straight to the cart.
+func priceListSections() []ListSection {
+	lines := strings.Split(strings.TrimSpace(PriceListAsAString()), "\n")
+	rows := make([]ListRow, 0, len(lines))
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		itemNum := len(rows) + 1
+		rows = append(rows, ListRow{
+			ID:    fmt.Sprintf("update order: %d:1", itemNum),
+			Title: line,
+		})
+	}
+	return []ListSection{{Title: "Price List", Rows: rows}}
+}
+
+// trySendPriceList sends the price list as a tappable product list when the
+// transport supports interactive messages, reporting whether it did so.
+// Callers should fall back to the plain-text price list when it returns
+// false.
+func (c *ChatClient) trySendPriceList(ui UserInfo) bool {
+	if c.Transport == nil || !c.Transport.Capabilities().SupportsButtons {
+		return false
+	}
+	if err := c.SendList(ui.CellNumber, tr(ui, "prclstPreamble", updateOrderCommand, fullOrderExample), priceListSections()); err != nil {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,178 @@
+package whatsappbot
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// ChatHandler is the shape of ChatBegin: whatever ultimately handles an
+// inbound conversation turn. Middleware wraps a ChatHandler to produce
+// another one, so the chain composes the same way net/http's does.
+type ChatHandler func(convo ConversationContext, db *sql.DB, checkoutUrls CheckoutInfo, isAutoInc bool)
+
+// Middleware wraps a ChatHandler with cross-cutting behaviour (rate
+// limiting, anti-spam heuristics, audit logging, panic recovery) that has
+// to run before ChatBegin ever touches the database.
+type Middleware func(next ChatHandler) ChatHandler
+
+// Use composes mw around the terminal ChatBegin handler, in the order
+// given: the first middleware in mw sees the conversation first. Calling Use
+// again replaces the previously composed chain.
+func (c *ChatClient) Use(mw ...Middleware) {
+	handler := ChatHandler(c.chatBegin)
+	for i := len(mw) - 1; i >= 0; i-- {
+		handler = mw[i](handler)
+	}
+	c.handler = handler
+}
+
+// RateLimitConfig bounds a token-bucket-style sliding window: at most
+// PerMinute messages in any rolling minute, and at most PerHour in any
+// rolling hour.
+type RateLimitConfig struct {
+	PerMinute int
+	PerHour   int
+}
+
+// recordRateLimitHit records a hit for jid in the rate_limit table and
+// reports whether it falls within both of cfg's sliding windows. State
+// lives in the database rather than in process memory, so the limit holds
+// across restarts and across multiple bot instances sharing one db, and a
+// hit is pruned once it's aged out of the longer of the two windows instead
+// of being kept forever.
+func recordRateLimitHit(db *sql.DB, jid string, cfg RateLimitConfig) (bool, error) {
+	now := time.Now()
+	minuteCutoff := now.Add(-time.Minute)
+	hourCutoff := now.Add(-time.Hour)
+
+	var perMinuteCount, perHourCount int
+	row := db.QueryRow(`
+		SELECT COUNT(*) FILTER (WHERE hit_at > $2), COUNT(*) FILTER (WHERE hit_at > $3)
+		FROM rate_limit WHERE jid = $1`, jid, minuteCutoff, hourCutoff)
+	if err := row.Scan(&perMinuteCount, &perHourCount); err != nil {
+		return false, fmt.Errorf("unhandled error checking rate limit: %v", err)
+	}
+	if perMinuteCount >= cfg.PerMinute || perHourCount >= cfg.PerHour {
+		return false, nil
+	}
+
+	if _, err := db.Exec(`INSERT INTO rate_limit (jid, hit_at) VALUES ($1, $2)`, jid, now); err != nil {
+		return false, fmt.Errorf("unhandled error recording rate limit hit: %v", err)
+	}
+	if _, err := db.Exec(`DELETE FROM rate_limit WHERE jid = $1 AND hit_at < $2`, jid, hourCutoff); err != nil {
+		return false, fmt.Errorf("unhandled error pruning rate limit hits: %v", err)
+	}
+	return true, nil
+}
+
+// RateLimit enforces per-sender sliding-window limits, keyed by the
+// sender's CellNumber as the transport delivered it; the key is not passed
+// through Transport.NormalizeJID. A sender who trips either window is silently dropped rather than
+// reaching ChatBegin (and, downstream, the rest of the database).
+func RateLimit(cfg RateLimitConfig) Middleware {
+	return func(next ChatHandler) ChatHandler {
+		return func(convo ConversationContext, db *sql.DB, checkoutUrls CheckoutInfo, isAutoInc bool) {
+			jid := convo.UserInfo.CellNumber
+			allowed, err := recordRateLimitHit(db, jid, cfg)
+			if err != nil {
+				log.Println(err.Error())
+			} else if !allowed {
+				log.Printf("rate limit: %s exceeded %d/minute or %d/hour, dropping", jid, cfg.PerMinute, cfg.PerHour)
+				return
+			}
+			next(convo, db, checkoutUrls, isAutoInc)
+		}
+	}
+}
+
+// AntiSpamConfig bounds how aggressively duplicate messages are treated as
+// abuse.
+type AntiSpamConfig struct {
+	// DuplicateWithin is how soon a repeated message body from the same
+	// sender is treated as spam rather than a resend.
+	DuplicateWithin time.Duration
+}
+
+// recordLastMessage upserts jid's last_message row and reports whether the
+// previous one had the same body within duplicateWithin. Keeping this in
+// the last_message table rather than an in-process map means the check
+// holds across restarts and across multiple bot instances, and it can
+// never leak memory - it's one row per sender, replaced on every message,
+// not one entry per message.
+func recordLastMessage(db *sql.DB, jid, body string, duplicateWithin time.Duration) (isDuplicate bool, err error) {
+	now := time.Now()
+
+	var prevBody string
+	var prevAt time.Time
+	switch err := db.QueryRow(`SELECT body, sent_at FROM last_message WHERE jid = $1`, jid).Scan(&prevBody, &prevAt); err {
+	case nil:
+		isDuplicate = prevBody == body && now.Sub(prevAt) < duplicateWithin
+	case sql.ErrNoRows:
+		// First message from this sender - nothing to compare against.
+	default:
+		return false, fmt.Errorf("unhandled error checking last message: %v", err)
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO last_message (jid, body, sent_at) VALUES ($1, $2, $3)
+		ON CONFLICT (jid) DO UPDATE SET body = EXCLUDED.body, sent_at = EXCLUDED.sent_at`,
+		jid, body, now)
+	if err != nil {
+		return false, fmt.Errorf("unhandled error recording last message: %v", err)
+	}
+	return isDuplicate, nil
+}
+
+// AntiSpam greylists senders who fire the exact same message body at the
+// bot faster than a human plausibly would.
+func AntiSpam(cfg AntiSpamConfig) Middleware {
+	return func(next ChatHandler) ChatHandler {
+		return func(convo ConversationContext, db *sql.DB, checkoutUrls CheckoutInfo, isAutoInc bool) {
+			jid := convo.UserInfo.CellNumber
+
+			isDuplicate, err := recordLastMessage(db, jid, convo.MessageBody, cfg.DuplicateWithin)
+			if err != nil {
+				log.Println(err.Error())
+			} else if isDuplicate {
+				log.Printf("anti-spam: %s sent a duplicate message within %s, dropping", jid, cfg.DuplicateWithin)
+				return
+			}
+			next(convo, db, checkoutUrls, isAutoInc)
+		}
+	}
+}
+
+// AuditLog writes a line per conversation turn to sink before it reaches
+// the terminal handler, for after-the-fact review of what a public,
+// payment-taking number was asked to do.
+func AuditLog(sink io.Writer) Middleware {
+	return func(next ChatHandler) ChatHandler {
+		return func(convo ConversationContext, db *sql.DB, checkoutUrls CheckoutInfo, isAutoInc bool) {
+			fmt.Fprintf(sink, "%s %s: %s\n", time.Now().Format(time.RFC3339), convo.UserInfo.CellNumber, convo.MessageBody)
+			next(convo, db, checkoutUrls, isAutoInc)
+		}
+	}
+}
+
+// Recover stops a panic anywhere downstream from taking the whole process
+// down, logging it and letting the sender know something went wrong
+// instead. It's a method rather than a free function (unlike the other
+// middleware here) because telling the sender requires c.SendMessage.
+func (c *ChatClient) Recover() Middleware {
+	return func(next ChatHandler) ChatHandler {
+		return func(convo ConversationContext, db *sql.DB, checkoutUrls CheckoutInfo, isAutoInc bool) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("recovered from panic handling %s: %v", convo.UserInfo.CellNumber, r)
+					if err := c.SendMessage(convo.UserInfo.CellNumber, tr(convo.UserInfo, "unhandledCommandException")); err != nil {
+						log.Println(err.Error())
+					}
+				}
+			}()
+			next(convo, db, checkoutUrls, isAutoInc)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package whatsappbot
+
+import (
+	"crypto/md5"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// OrderUpdate is what a PaymentProvider's webhook handler reports back once
+// it has verified and decoded a gateway notification.
+type OrderUpdate struct {
+	OrderID   string
+	Status    string
+	Reference string
+}
+
+// PaymentProvider is a checkout gateway. CreateCheckout starts a payment and
+// returns where to send the customer; HandleWebhook verifies and decodes an
+// inbound notification from that gateway.
+type PaymentProvider interface {
+	Name() string
+	CreateCheckout(cart CheckoutCart, urls CheckoutInfo) (redirectURL string, reference string, err error)
+	HandleWebhook(r *http.Request) (OrderUpdate, error)
+}
+
+var (
+	paymentProviderMu sync.RWMutex
+	paymentProviders  = map[string]PaymentProvider{}
+)
+
+// RegisterPaymentProvider makes a gateway available under the name used by
+// CheckoutInfo.Provider.
+func RegisterPaymentProvider(provider PaymentProvider) {
+	paymentProviderMu.Lock()
+	defer paymentProviderMu.Unlock()
+	paymentProviders[provider.Name()] = provider
+}
+
+// GetPaymentProvider looks up a registered gateway by name.
+func GetPaymentProvider(name string) (PaymentProvider, error) {
+	paymentProviderMu.RLock()
+	defer paymentProviderMu.RUnlock()
+	provider, ok := paymentProviders[name]
+	if !ok {
+		return nil, fmt.Errorf("no payment provider registered under name: %s", name)
+	}
+	return provider, nil
+}
+
+func init() {
+	RegisterPaymentProvider(payFastProvider{})
+	RegisterPaymentProvider(stripeProvider{})
+	RegisterPaymentProvider(yocoProvider{})
+	RegisterPaymentProvider(manualEFTProvider{})
+}
+
+// payFastProvider is the existing target gateway, judging by
+// CheckoutInfo's ReturnURL/CancelURL/NotifyURL fields.
+type payFastProvider struct{}
+
+func (payFastProvider) Name() string { return "payfast" }
+
+func (payFastProvider) CreateCheckout(cart CheckoutCart, urls CheckoutInfo) (string, string, error) {
+	return ProcessPayment(cart, urls), cart.OrderID, nil
+}
+
+// payFastPassphrase is the merchant's PayFast security passphrase, set in
+// the PayFast dashboard and required to reproduce its ITN signature. Left
+// unset, PayFast's own signature calculation omits it too - but a sandbox
+// merchant with no passphrase configured should not be treated the same as
+// production, so deployments handling real money must set this.
+var payFastPassphrase = os.Getenv("PAYFAST_PASSPHRASE")
+
+// payFastHosts are the only hosts PayFast ever sends ITN webhooks from.
+// Anything else hitting this endpoint can't be a genuine notification, no
+// matter what signature it presents.
+var payFastHosts = []string{"www.payfast.co.za", "sandbox.payfast.co.za"}
+
+func (payFastProvider) HandleWebhook(r *http.Request) (OrderUpdate, error) {
+	if !originatesFromPayFast(r.RemoteAddr) {
+		return OrderUpdate{}, fmt.Errorf("PayFast ITN rejected: request did not originate from a known PayFast host")
+	}
+
+	rawBody, err := io.ReadAll(r.Body)
+	if err != nil {
+		return OrderUpdate{}, fmt.Errorf("unhandled error reading PayFast ITN payload: %v", err)
+	}
+
+	values, err := url.ParseQuery(string(rawBody))
+	if err != nil {
+		return OrderUpdate{}, fmt.Errorf("unhandled error parsing PayFast ITN payload: %v", err)
+	}
+
+	if !verifyPayFastSignature(string(rawBody), payFastPassphrase, values.Get("signature")) {
+		return OrderUpdate{}, fmt.Errorf("PayFast ITN rejected: signature mismatch")
+	}
+
+	return OrderUpdate{
+		OrderID:   values.Get("m_payment_id"),
+		Status:    values.Get("payment_status"),
+		Reference: values.Get("pf_payment_id"),
+	}, nil
+}
+
+// verifyPayFastSignature reproduces PayFast's ITN signature: an MD5 hash of
+// the raw posted fields, in the order PayFast sent them, with the
+// signature field itself excluded and the merchant's passphrase appended
+// if one is configured. rawBody must be the untouched
+// application/x-www-form-urlencoded request body - re-encoding the parsed
+// values would reorder them and the signature would never match.
+func verifyPayFastSignature(rawBody, passphrase, gotSignature string) bool {
+	if gotSignature == "" {
+		return false
+	}
+
+	var kept []string
+	for _, pair := range strings.Split(rawBody, "&") {
+		if pair == "" {
+			continue
+		}
+		key, _, _ := strings.Cut(pair, "=")
+		if key == "signature" {
+			continue
+		}
+		kept = append(kept, pair)
+	}
+
+	base := strings.Join(kept, "&")
+	if passphrase != "" {
+		base += "&passphrase=" + url.QueryEscape(passphrase)
+	}
+
+	sum := md5.Sum([]byte(base))
+	return strings.EqualFold(hex.EncodeToString(sum[:]), gotSignature)
+}
+
+// originatesFromPayFast reports whether remoteAddr resolves to one of
+// PayFast's own ITN-sending hosts, as an extra check alongside the
+// signature itself.
+func originatesFromPayFast(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	for _, payFastHost := range payFastHosts {
+		ips, err := net.LookupHost(payFastHost)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			if ip == host {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// stripeProvider is not yet configured with live API keys; it exists so the
+// registry and webhook plumbing can be wired up ahead of that.
+type stripeProvider struct{}
+
+func (stripeProvider) Name() string { return "stripe" }
+
+func (stripeProvider) CreateCheckout(cart CheckoutCart, urls CheckoutInfo) (string, string, error) {
+	return "", "", fmt.Errorf("stripe provider is not configured")
+}
+
+func (stripeProvider) HandleWebhook(r *http.Request) (OrderUpdate, error) {
+	return OrderUpdate{}, fmt.Errorf("stripe provider is not configured")
+}
+
+// yocoProvider is not yet configured with live API keys.
+type yocoProvider struct{}
+
+func (yocoProvider) Name() string { return "yoco" }
+
+func (yocoProvider) CreateCheckout(cart CheckoutCart, urls CheckoutInfo) (string, string, error) {
+	return "", "", fmt.Errorf("yoco provider is not configured")
+}
+
+func (yocoProvider) HandleWebhook(r *http.Request) (OrderUpdate, error) {
+	return OrderUpdate{}, fmt.Errorf("yoco provider is not configured")
+}
+
+// manualEFTProvider has no redirect at all: CreateCheckout returns an empty
+// redirect URL and the order ID as the reference, and supplies no bank
+// details. It has no webhook since there's nothing to notify us.
+type manualEFTProvider struct{}
+
+func (manualEFTProvider) Name() string { return "manual-eft" }
+
+func (manualEFTProvider) CreateCheckout(cart CheckoutCart, urls CheckoutInfo) (string, string, error) {
+	return "", cart.OrderID, nil
+}
+
+func (manualEFTProvider) HandleWebhook(r *http.Request) (OrderUpdate, error) {
+	return OrderUpdate{}, fmt.Errorf("manual EFT has no webhook - orders must be confirmed manually")
+}
+
+// markWebhookProcessed records that orderID's webhook has been applied, so
+// a gateway retrying delivery (PayFast does this on anything but a 200)
+// doesn't double-credit the order. The INSERT/ON CONFLICT makes the
+// check-and-set atomic across replicas, unlike an in-process map: whichever
+// instance's insert actually lands is the one that applies the update. It
+// runs inside the caller's transaction rather than committing on its own,
+// so the marker can be rolled back alongside a failed order update instead
+// of permanently burning the idempotency key for an update that never
+// actually applied.
+func markWebhookProcessed(tx *sql.Tx, orderID string) (alreadyProcessed bool, err error) {
+	res, err := tx.Exec(`INSERT INTO processed_webhooks (order_id) VALUES ($1) ON CONFLICT (order_id) DO NOTHING`, orderID)
+	if err != nil {
+		return false, fmt.Errorf("unhandled error recording processed webhook: %v", err)
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("unhandled error checking processed webhook insert: %v", err)
+	}
+	return rows == 0, nil
+}
+
+// NewWebhookHandler returns an http.Handler that verifies and applies a
+// payment provider's webhook notifications for the provider registered
+// under providerName (e.g. mounted at "/webhooks/payfast" with "payfast").
+// The processed marker is written in a transaction that is committed only
+// once UpdateOrderStatus has succeeded - so if UpdateOrderStatus fails, the
+// marker rolls back and the next retry of the same ITN gets a real second
+// attempt instead of being swallowed as already-handled. UpdateOrderStatus
+// itself runs on db, outside that transaction, so a failed commit leaves
+// the order update applied without the marker.
+func NewWebhookHandler(db *sql.DB, providerName string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provider, err := GetPaymentProvider(providerName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		update, err := provider.HandleWebhook(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("unhandled error starting webhook transaction: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		alreadyProcessed, err := markWebhookProcessed(tx, update.OrderID)
+		if err != nil {
+			tx.Rollback()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if alreadyProcessed {
+			tx.Rollback()
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		if err := UpdateOrderStatus(db, update.OrderID, update.Status); err != nil {
+			tx.Rollback()
+			http.Error(w, fmt.Sprintf("unhandled error applying order update: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			http.Error(w, fmt.Sprintf("unhandled error committing processed webhook marker: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+}
@@ -0,0 +1,47 @@
+package whatsappbot
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"testing"
+)
+
+func TestVerifyPayFastSignatureMatchesKnownGoodPayload(t *testing.T) {
+	body := "m_payment_id=order-1&amount_gross=100.00&payment_status=COMPLETE"
+	base := body + "&passphrase=letmein"
+	signature := md5Hex(base)
+
+	if !verifyPayFastSignature(body+"&signature="+signature, "letmein", signature) {
+		t.Fatal("expected a signature computed the same way PayFast would to verify")
+	}
+}
+
+func TestVerifyPayFastSignatureRejectsTamperedPayload(t *testing.T) {
+	body := "m_payment_id=order-1&amount_gross=100.00&payment_status=COMPLETE"
+	signature := md5Hex(body + "&passphrase=letmein")
+
+	tampered := "m_payment_id=order-1&amount_gross=1.00&payment_status=COMPLETE"
+	if verifyPayFastSignature(tampered+"&signature="+signature, "letmein", signature) {
+		t.Fatal("expected a signature computed over the original amount to reject a tampered amount")
+	}
+}
+
+func TestVerifyPayFastSignatureRejectsMissingSignature(t *testing.T) {
+	if verifyPayFastSignature("m_payment_id=order-1", "letmein", "") {
+		t.Fatal("expected an empty signature to be rejected")
+	}
+}
+
+func TestVerifyPayFastSignatureWithNoPassphraseConfigured(t *testing.T) {
+	body := "m_payment_id=order-1&payment_status=COMPLETE"
+	signature := md5Hex(body)
+
+	if !verifyPayFastSignature(body+"&signature="+signature, "", signature) {
+		t.Fatal("expected a signature computed with no passphrase to verify when none is configured")
+	}
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
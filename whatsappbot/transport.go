@@ -0,0 +1,181 @@
+package whatsappbot
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/febriliankr/whatsapp-cloud-api"
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+// Capabilities describes the optional features a Transport supports, so the
+// command layer can decide whether to degrade gracefully (e.g. fall back to
+// plain text instead of buttons).
+type Capabilities struct {
+	SupportsButtons          bool
+	SupportsMedia            bool
+	SupportsTypingIndicators bool
+}
+
+// Transport is implemented by every chat backend ChatClient can dispatch
+// through. Message IDs, user identifiers and presence semantics differ per
+// backend, so anything backend-specific lives behind this interface instead
+// of leaking into the command dispatcher.
+type Transport interface {
+	SendMessage(destinationNum, chatMessage string) error
+	ReceiveLoop(ctx context.Context, handle func(ConversationContext)) error
+	Identity() string
+	NormalizeJID(raw string) string
+	Capabilities() Capabilities
+}
+
+// TransportFactory builds a Transport from backend-specific configuration.
+type TransportFactory func(cfg interface{}) (Transport, error)
+
+var (
+	transportRegistryMu sync.RWMutex
+	transportRegistry   = map[string]TransportFactory{}
+)
+
+// RegisterTransport makes a backend available by name, e.g. "whatsmeow",
+// "cloud-api", "matrix", "telegram" or "cli". Backends outside this package
+// (Matrix bridges, Telegram, a local CLI for testing, ...) register
+// themselves through this same entry point, so ChatBegin never needs to know
+// which one it's talking to.
+func RegisterTransport(name string, factory TransportFactory) {
+	transportRegistryMu.Lock()
+	defer transportRegistryMu.Unlock()
+	transportRegistry[name] = factory
+}
+
+// NewTransport looks up a registered backend by name and constructs it.
+func NewTransport(name string, cfg interface{}) (Transport, error) {
+	transportRegistryMu.RLock()
+	factory, ok := transportRegistry[name]
+	transportRegistryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no transport registered under name: %s", name)
+	}
+	return factory(cfg)
+}
+
+func init() {
+	RegisterTransport("whatsmeow", func(cfg interface{}) (Transport, error) {
+		client, ok := cfg.(*whatsmeow.Client)
+		if !ok {
+			return nil, fmt.Errorf("whatsmeow transport requires a *whatsmeow.Client config")
+		}
+		return &whatsmeowTransport{client: client}, nil
+	})
+	RegisterTransport("cloud-api", func(cfg interface{}) (Transport, error) {
+		client, ok := cfg.(*whatsapp.Whatsapp)
+		if !ok {
+			return nil, fmt.Errorf("cloud-api transport requires a *whatsapp.Whatsapp config")
+		}
+		return &cloudAPITransport{client: client}, nil
+	})
+}
+
+// whatsmeowTransport backs the multi-device whatsmeow protocol.
+type whatsmeowTransport struct {
+	client *whatsmeow.Client
+}
+
+func (t *whatsmeowTransport) SendMessage(destinationNum, chatMessage string) error {
+	jId := types.NewJID(destinationNum, whatsAppServer)
+	_, err := t.client.SendMessage(context.Background(), jId, &waProto.Message{Conversation: proto.String(chatMessage)})
+	return err
+}
+
+// ReceiveLoop registers a whatsmeow event handler for the lifetime of ctx,
+// translating every inbound conversation message - plain text or a tapped
+// button/list reply - into a ConversationContext and handing it to handle.
+// It blocks until ctx is cancelled.
+func (t *whatsmeowTransport) ReceiveLoop(ctx context.Context, handle func(ConversationContext)) error {
+	handlerID := t.client.AddEventHandler(func(rawEvt interface{}) {
+		evt, ok := rawEvt.(*events.Message)
+		if !ok {
+			return
+		}
+		body := whatsmeowMessageBody(evt.Message)
+		if body == "" {
+			return
+		}
+		handle(ConversationContext{
+			UserInfo:    UserInfo{CellNumber: evt.Info.Sender.User},
+			MessageBody: body,
+		})
+	})
+	defer t.client.RemoveEventHandler(handlerID)
+
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// whatsmeowMessageBody extracts the text a conversation turn should be
+// dispatched on: plain/extended text as typed, or - for a tapped button or
+// selected list row - the ID the user picked, so the command dispatcher
+// treats a tap exactly like the equivalent typed command.
+func whatsmeowMessageBody(msg *waProto.Message) string {
+	if msg == nil {
+		return ""
+	}
+	switch {
+	case msg.GetConversation() != "":
+		return msg.GetConversation()
+	case msg.GetExtendedTextMessage().GetText() != "":
+		return msg.GetExtendedTextMessage().GetText()
+	case msg.GetButtonsResponseMessage().GetSelectedButtonId() != "":
+		return msg.GetButtonsResponseMessage().GetSelectedButtonId()
+	case msg.GetListResponseMessage().GetSingleSelectReply().GetSelectedRowId() != "":
+		return msg.GetListResponseMessage().GetSingleSelectReply().GetSelectedRowId()
+	default:
+		return ""
+	}
+}
+
+func (t *whatsmeowTransport) Identity() string {
+	if t.client.Store == nil || t.client.Store.ID == nil {
+		return ""
+	}
+	return t.client.Store.ID.String()
+}
+
+func (t *whatsmeowTransport) NormalizeJID(raw string) string {
+	return types.NewJID(raw, whatsAppServer).String()
+}
+
+func (t *whatsmeowTransport) Capabilities() Capabilities {
+	return Capabilities{SupportsButtons: true, SupportsMedia: true, SupportsTypingIndicators: true}
+}
+
+// cloudAPITransport backs Meta's hosted WhatsApp Cloud API.
+type cloudAPITransport struct {
+	client *whatsapp.Whatsapp
+}
+
+func (t *cloudAPITransport) SendMessage(destinationNum, chatMessage string) error {
+	_, err := t.client.SendText(destinationNum, chatMessage)
+	return err
+}
+
+func (t *cloudAPITransport) ReceiveLoop(ctx context.Context, handle func(ConversationContext)) error {
+	return fmt.Errorf("cloud-api transport: inbound messages arrive via webhook, not a receive loop")
+}
+
+func (t *cloudAPITransport) Identity() string {
+	return "cloud-api"
+}
+
+func (t *cloudAPITransport) NormalizeJID(raw string) string {
+	return raw
+}
+
+func (t *cloudAPITransport) Capabilities() Capabilities {
+	return Capabilities{SupportsButtons: true, SupportsMedia: true, SupportsTypingIndicators: false}
+}
@@ -1,75 +1,52 @@
 package whatsappbot
 
 import (
-	"context"
 	"errors"
 	"fmt"
 	"log"
 	"net/url"
-	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"database/sql"
 
 	"github.com/febriliankr/whatsapp-cloud-api"
 	_ "github.com/lib/pq"
 	"go.mau.fi/whatsmeow"
-	waProto "go.mau.fi/whatsmeow/binary/proto"
-	"go.mau.fi/whatsmeow/types"
-	"google.golang.org/protobuf/proto"
+
+	"github.com/JeremyJalpha/whatsappbot/whatsappbot/cmd"
 )
 
 const (
 	whatsAppServer = "s.whatsapp.net"
-	sayMenu        = "For a command list please type & send-: menu?\nPlease include the question mark."
-
-	reminderGreeting = "Please save your email address, by typing & sending-: update email: example@emailprovider.com"
-
-	coldGreeting = "Hello there, I don't believe we've met before."
-
-	smartyPantsGreeting = "Hey there smarty pants, I see you've been here before."
-
-	noCommandText = "Err:NC, Sorry I couldn't identify a command in your mesasge."
-
-	unhandledCommandException = "Err:CF, Something went wrong processing your request."
 
 	updateOrderCommand = `update order 1:newAmount, 3:newAmount, 2:newAmount, ...
 where 1, 2 or 3 is the item number as listed in the price list - item order not important.
 
 For items with options please use the format-: 1x3, 3x1, 2x2, ...
 The first number is the option's hierarchical menu position and the second is your desired amount of that option.`
-
-	fullOrderExample = `An order of: 
-12 grams of Peanut butter breath, 
-3 Blue dream cannisters, 
-2 Slurricane cannister,
-1 GMO cannisters and 
-5 grams of Strawberry cheesecake.
-
-Should look like-: update order 9:12, 10: 1x3, 3x2, 2x1, 6:5`
-
-	prclstPreamble = `Welcome to Flying Rasta,
-
-to save your order please type & send-:` + updateOrderCommand + "\n\n" + fullOrderExample + ` 
-
-To checkout type & send-: checkoutnow?`
-
-	mainMenu = `Main Menu, command list:
-
-fr.prlist? - Prints the Flying Rasta price list.
-
-menu? - Prints this menu.
-userinfo? - Prints your user info.
-currentorder? - Prints your current pending order.
-checkoutnow? - Prints a payment link for your current basket.
-
-update email: newEmail
-update nickname: newNickname
-update social: newSocial
-update consent: newConsent` + "\n\n" + updateOrderCommand
 )
 
+// fullOrderExample is a worked "update order" example alongside
+// updateOrderCommand. Each line's quantity noun runs through Pluralize
+// rather than being picked by hand, the same one/many split order summaries
+// use elsewhere - the hand-picked wording this replaced had it backwards
+// for "2 Slurricane cannister" and "1 GMO cannisters".
+var fullOrderExample = fmt.Sprintf(`An order of:
+12 %s of Peanut butter breath,
+3 %s,
+2 %s,
+1 %s and
+5 %s of Strawberry cheesecake.
+
+Should look like-: update order 9:12, 10: 1x3, 3x2, 2x1, 6:5`,
+	Pluralize(12, "gram", "grams"),
+	Pluralize(3, "Blue dream cannister", "Blue dream cannisters"),
+	Pluralize(2, "Slurricane cannister", "Slurricane cannisters"),
+	Pluralize(1, "GMO cannister", "GMO cannisters"),
+	Pluralize(5, "gram", "grams"))
+
 type Command interface {
 	Execute(db *sql.DB, ui UserInfo, isAutoInc bool) error
 }
@@ -94,8 +71,53 @@ type QuestionCommand struct {
 }
 
 type ChatClient struct {
-	*whatsmeow.Client
-	*whatsapp.Whatsapp
+	Transport Transport
+
+	// handler is the composed middleware chain built by Use; nil means no
+	// middleware has been registered and chatBegin runs directly.
+	handler ChatHandler
+}
+
+// defaultRateLimit and defaultAntiSpam are the limits NewChatClient wires on
+// by default - generous enough not to bother a real customer, tight enough
+// to blunt a script hammering the number.
+var (
+	defaultRateLimit = RateLimitConfig{PerMinute: 20, PerHour: 200}
+	defaultAntiSpam  = AntiSpamConfig{DuplicateWithin: 10 * time.Second}
+)
+
+// NewChatClient wires a ChatClient up to a backend registered with
+// RegisterTransport, e.g. NewChatClient("whatsmeow", waClient), and turns on
+// its default middleware chain (rate limiting, anti-spam, audit logging,
+// panic recovery) so every transport gets the same protection without each
+// call site having to remember to call Use itself.
+func NewChatClient(transportName string, cfg interface{}) (*ChatClient, error) {
+	transport, err := NewTransport(transportName, cfg)
+	if err != nil {
+		return nil, err
+	}
+	c := &ChatClient{Transport: transport}
+	c.Use(
+		RateLimit(defaultRateLimit),
+		AntiSpam(defaultAntiSpam),
+		AuditLog(log.Writer()),
+		c.Recover(),
+	)
+	return c, nil
+}
+
+// NewWhatsmeowChatClient is a drop-in replacement for call sites that used
+// to build ChatClient{Client: client} directly against the whatsmeow
+// backend before Transport existed.
+func NewWhatsmeowChatClient(client *whatsmeow.Client) (*ChatClient, error) {
+	return NewChatClient("whatsmeow", client)
+}
+
+// NewCloudAPIChatClient is a drop-in replacement for call sites that used to
+// build ChatClient{Whatsapp: client} directly against the Cloud API backend
+// before Transport existed.
+func NewCloudAPIChatClient(client *whatsapp.Whatsapp) (*ChatClient, error) {
+	return NewChatClient("cloud-api", client)
 }
 
 type Chat interface {
@@ -103,24 +125,14 @@ type Chat interface {
 }
 
 func (c *ChatClient) SendMessage(destinationNum, chatMessage string) error {
-	if c.Client != nil {
-		jId := types.NewJID(destinationNum, whatsAppServer)
-		_, err := c.Client.SendMessage(context.Background(), jId, &waProto.Message{Conversation: proto.String(chatMessage)})
-		if err != nil {
-			log.Printf("ReturnToUser Failed with: " + err.Error())
-			return fmt.Errorf("ReturnToUser Failed with: " + err.Error())
-		}
-		return nil
-	} else if c.Whatsapp != nil {
-		_, err := c.SendText(destinationNum, chatMessage)
-		if err != nil {
-			log.Println("ReturnToUser Failed with: " + err.Error())
-			return fmt.Errorf("ReturnToUser Failed with: " + err.Error())
-		}
-		return nil
-	} else {
+	if c.Transport == nil {
 		return errors.New("WhatsApp client object not instantiated")
 	}
+	if err := c.Transport.SendMessage(destinationNum, chatMessage); err != nil {
+		log.Println("ReturnToUser Failed with: " + err.Error())
+		return fmt.Errorf("ReturnToUser Failed with: " + err.Error())
+	}
+	return nil
 }
 
 func (cmd UpdateUserInfoCommand) Execute(db *sql.DB, ui UserInfo, isAutoInc bool) error {
@@ -147,7 +159,7 @@ func (cmd UpdateOrderCommand) Execute(db *sql.DB, ui UserInfo, isAutoInc bool) e
 	if err != nil {
 		return fmt.Errorf("unhandled error updating order: %v", err)
 	}
-	return errors.New("successfully updated current order")
+	return fmt.Errorf("successfully updated %d %s in your order", len(updates), Pluralize(len(updates), "item", "items"))
 }
 
 func (cmd QuestionCommand) Execute(db *sql.DB, ui UserInfo, isAutoInc bool) error {
@@ -178,7 +190,24 @@ func BeginCheckout(db *sql.DB, ui UserInfo, c CustomerOrder, checkoutUrls Checko
 		CustFirstName: ui.NickName.String,
 		CustLastName:  ui.CellNumber,
 		CustEmail:     ui.Email.String}
-	return cartSummary + "/n/n" + ProcessPayment(cart, checkoutUrls)
+
+	provider, err := GetPaymentProvider(checkoutUrls.Provider)
+	if err != nil {
+		return err.Error()
+	}
+	redirectURL, _, err := provider.CreateCheckout(cart, checkoutUrls)
+	if err != nil {
+		return fmt.Errorf("unhandled error creating checkout: %v", err).Error()
+	}
+	return cartSummary + "/n/n" + redirectURL
+}
+
+// mainMenuText renders the main menu in ui's locale, with commandHelpText
+// (the generated "update <field>"/"update order" syntax lines) and
+// updateOrderCommand (the "update order ..." syntax block, the same in
+// every locale) spliced into the translated template.
+func mainMenuText(ui UserInfo) string {
+	return tr(ui, "mainMenu", commandHelpText(), updateOrderCommand)
 }
 
 func parseQuestionCommand(match string, ui UserInfo, c CustomerOrder, db *sql.DB, checkoutUrls CheckoutInfo, isAutoInc bool) Command {
@@ -186,13 +215,13 @@ func parseQuestionCommand(match string, ui UserInfo, c CustomerOrder, db *sql.DB
 	case "currentorder?":
 		return QuestionCommand{CommandData: CommandData{Name: "currentorder", Text: c.GetCurrentOrderAsAString(db, ui.CellNumber, isAutoInc)}}
 	case "fr.prlist?":
-		return QuestionCommand{CommandData: CommandData{Name: "fr.prlist", Text: prclstPreamble + "\n\n" + PriceListAsAString()}}
+		return QuestionCommand{CommandData: CommandData{Name: "fr.prlist", Text: priceListText(ui)}}
 	case "userinfo?":
 		return QuestionCommand{CommandData: CommandData{Name: "userinfo", Text: ui.GetUserInfoAsAString()}}
 	case "checkoutnow?":
 		return QuestionCommand{CommandData: CommandData{Name: "checkoutnow", Text: BeginCheckout(db, ui, c, checkoutUrls, isAutoInc)}}
 	default:
-		return QuestionCommand{CommandData: CommandData{Name: "menu", Text: mainMenu}}
+		return QuestionCommand{CommandData: CommandData{Name: "menu", Text: mainMenuText(ui)}}
 	}
 }
 
@@ -207,8 +236,47 @@ func (cc CommandCollection) ProcessCommands(ui UserInfo, db *sql.DB, isAutoInc b
 	return strings.Join(errors, "\n")
 }
 
+// ChatBegin is the entry point for an inbound conversation turn. It runs
+// whatever middleware chain Use registered, terminating in chatBegin; with
+// no middleware registered it calls chatBegin directly.
 func (c *ChatClient) ChatBegin(convo ConversationContext, db *sql.DB, checkoutUrls CheckoutInfo, isAutoInc bool) {
-	commandRes := unhandledCommandException
+	if c.handler != nil {
+		c.handler(convo, db, checkoutUrls, isAutoInc)
+		return
+	}
+	c.chatBegin(convo, db, checkoutUrls, isAutoInc)
+}
+
+func (c *ChatClient) chatBegin(convo ConversationContext, db *sql.DB, checkoutUrls CheckoutInfo, isAutoInc bool) {
+	// First contact: guess a locale from the sender's dialing code rather
+	// than defaulting everyone to English. They can still correct it with
+	// "update locale: xx".
+	if !convo.UserExisted && convo.UserInfo.Locale == "" {
+		convo.UserInfo.Locale = DetectLocale(convo.UserInfo.CellNumber)
+		if err := convo.UserInfo.UpdateSingularUserInfoField(db, "locale", convo.UserInfo.Locale); err != nil {
+			log.Println(err.Error())
+		}
+	}
+
+	commandRes := tr(convo.UserInfo, "unhandledCommandException")
+
+	// If the sender has an in-progress flow (a checkout wizard, say), route
+	// the raw message to it instead of the command parser until it's done.
+	if flowState, err := LoadActiveFlow(db, convo.UserInfo.CellNumber); err != nil {
+		log.Println(err.Error())
+	} else if flowState != nil {
+		c.continueFlow(*flowState, convo, db, checkoutUrls, isAutoInc)
+		return
+	} else if state, prompt, err := StartFlow(leadingKeyword(convo.MessageBody), convo.UserInfo.CellNumber); err == nil {
+		if saveErr := state.Save(db); saveErr != nil {
+			log.Println(saveErr.Error())
+		}
+		if sendErr := c.SendMessage(convo.UserInfo.CellNumber, prompt); sendErr != nil {
+			log.Println(sendErr.Error())
+		}
+		return
+	}
+
 	commands := GetCommandsFromLastMessage(convo.MessageBody, convo, db, checkoutUrls, isAutoInc)
 	if len(commands) != 0 {
 		// Process commands
@@ -217,22 +285,31 @@ func (c *ChatClient) ChatBegin(convo ConversationContext, db *sql.DB, checkoutUr
 			commandRes = commandRes_Temp
 		}
 	} else {
-		commandRes = noCommandText
+		commandRes = tr(convo.UserInfo, "noCommandText")
 	}
 
+	noCommand := tr(convo.UserInfo, "noCommandText")
 	if !convo.UserExisted {
-		if commandRes != noCommandText {
-			commandRes = smartyPantsGreeting + "\n\n" + commandRes + "\n\n" + reminderGreeting + "\n\n" + sayMenu
+		if commandRes != noCommand {
+			commandRes = tr(convo.UserInfo, "smartyPantsGreeting") + "\n\n" + commandRes + "\n\n" + tr(convo.UserInfo, "reminderGreeting") + "\n\n" + tr(convo.UserInfo, "sayMenu")
 		} else {
-			commandRes = coldGreeting + "\n\n" + reminderGreeting + "\n\n" + sayMenu
+			commandRes = tr(convo.UserInfo, "coldGreeting") + "\n\n" + tr(convo.UserInfo, "reminderGreeting") + "\n\n" + tr(convo.UserInfo, "sayMenu")
 		}
-	} else if commandRes == noCommandText {
-		commandRes += "\n\n" + sayMenu
+	} else if commandRes == noCommand {
+		commandRes += "\n\n" + tr(convo.UserInfo, "sayMenu")
 	}
 
 	convo.UserExisted = true
 
-	// Main - Send a WhatsApp response
+	// Main - Send a WhatsApp response. The menu and price list prefer
+	// tappable buttons/lists over the plain-text block when the transport
+	// supports them.
+	if commandRes == mainMenuText(convo.UserInfo) && c.trySendMenu(convo.UserInfo) {
+		return
+	}
+	if commandRes == priceListText(convo.UserInfo) && c.trySendPriceList(convo.UserInfo) {
+		return
+	}
 	err := c.SendMessage(convo.UserInfo.CellNumber, commandRes)
 	if err != nil {
 		log.Println(err.Error())
@@ -240,91 +317,167 @@ func (c *ChatClient) ChatBegin(convo ConversationContext, db *sql.DB, checkoutUr
 	}
 }
 
-// Precompile regular expressions
-var (
-	regexQuestionMark  = regexp.MustCompile(`(menu\?|fr\.prlist\?|userinfo\?|currentorder\?|checkoutnow\?)`)
-	regexUpdateField   = regexp.MustCompile(`(update email|update nickname|update social|update consent):\s*(\S*)`)
-	regexUpdateAnswers = regexp.MustCompile(`(update order):?\s*(.*)`)
-)
+// questionKeywords are the zero-argument commands recognised verbatim,
+// case-insensitively, on a line of their own.
+var questionKeywords = map[string]bool{
+	"menu?":         true,
+	"fr.prlist?":    true,
+	"userinfo?":     true,
+	"currentorder?": true,
+	"checkoutnow?":  true,
+}
+
+// updatableFields are the column names accepted by "update <field>: value".
+var updatableFields = map[string]bool{
+	"email":    true,
+	"nickname": true,
+	"social":   true,
+	"consent":  true,
+	"locale":   true,
+}
+
+// updatableFieldOrder lists the same fields as updatableFields, in the
+// order the main menu's command reference lists them - map iteration order
+// is random, but what a user reads shouldn't be.
+var updatableFieldOrder = []string{"email", "nickname", "social", "consent", "locale"}
+
+// fieldValue is the grammar for "update <field>: value" commands. Value is
+// tagged rest:"true", so Parse sweeps every remaining token into it, case
+// included, re-joined with single spaces - which is what lets nicknames
+// contain spaces and emails keep their original case.
+type fieldValue struct {
+	Value string `opt:"value" rest:"true"`
+}
+
+// orderItemsArgs is the grammar for "update order: ..." commands. Capturing
+// the remainder per line (rather than matching `.*` across the whole
+// message) is what stops one "update order" command from swallowing text
+// meant for a different command on a later line.
+type orderItemsArgs struct {
+	Items string `opt:"items" rest:"true"`
+}
+
+func init() {
+	cmd.Register("fieldvalue", fieldValue{})
+	cmd.Register("orderitems", orderItemsArgs{})
+	for _, field := range updatableFieldOrder {
+		cmd.Register("update "+field, fieldValue{})
+	}
+	cmd.Register("update order", orderItemsArgs{})
+}
+
+// commandHelpText renders the "update <field>"/"update order" syntax lines
+// of the main menu from cmd.Help against their registered grammars, instead
+// of hand-typing them, so this reference can't drift out of sync with what
+// GetCommandsFromLastMessage actually accepts.
+func commandHelpText() string {
+	lines := make([]string, 0, len(updatableFieldOrder)+1)
+	for _, field := range updatableFieldOrder {
+		lines = append(lines, cmd.Help("update "+field))
+	}
+	lines = append(lines, cmd.Help("update order"))
+	return strings.Join(lines, "\n")
+}
 
 func GetCommandsFromLastMessage(messageBody string, convo ConversationContext, db *sql.DB, checkoutUrls CheckoutInfo, isAutoInc bool) []Command {
 	var commands []Command
-	messageBody = strings.ToLower(messageBody)
 
-	// Use precompiled regular expressions
-	if matches := regexQuestionMark.FindAllStringSubmatch(messageBody, -1); matches != nil {
-		for _, match := range matches {
-			commands = append(commands, parseQuestionCommand(match[1], convo.UserInfo, convo.CurrentOrder, db, checkoutUrls, isAutoInc))
+	for _, line := range strings.Split(messageBody, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			continue
 		}
-	}
+		lower := strings.ToLower(trimmed)
 
-	if matches := regexUpdateField.FindAllStringSubmatch(messageBody, -1); matches != nil {
-		for _, match := range matches {
-			commands = append(commands, UpdateUserInfoCommand{CommandData: CommandData{Name: match[1], Text: match[2]}})
-		}
-	}
+		switch {
+		case questionKeywords[lower]:
+			commands = append(commands, parseQuestionCommand(lower, convo.UserInfo, convo.CurrentOrder, db, checkoutUrls, isAutoInc))
+
+		case strings.HasPrefix(lower, "update order"):
+			rest := strings.TrimPrefix(strings.TrimSpace(trimmed[len("update order"):]), ":")
+			parsed, err := cmd.Parse("orderitems", strings.TrimSpace(rest))
+			if err != nil {
+				continue
+			}
+			items := parsed.Value.(orderItemsArgs)
+			commands = append(commands, UpdateOrderCommand{CommandData: CommandData{Name: "update order", Text: "update order: " + items.Items}})
 
-	if matches := regexUpdateAnswers.FindAllStringSubmatch(messageBody, -1); matches != nil {
-		for _, match := range matches {
-			commands = append(commands, UpdateOrderCommand{CommandData: CommandData{Name: match[1], Text: match[2]}})
+		case strings.HasPrefix(lower, "update "):
+			field, value, ok := splitUpdateField(trimmed)
+			if !ok || !updatableFields[strings.ToLower(field)] {
+				continue
+			}
+			parsed, err := cmd.Parse("fieldvalue", value)
+			if err != nil {
+				continue
+			}
+			commands = append(commands, UpdateUserInfoCommand{CommandData: CommandData{Name: "update " + strings.ToLower(field), Text: parsed.Value.(fieldValue).Value}})
 		}
 	}
 
 	return commands
 }
 
+// leadingKeyword returns the first whitespace-separated token of a message,
+// lower-cased, so a flow name like "checkout" still triggers on "checkout
+// please" or "checkout?" instead of requiring the whole message to match.
+// Falls back to the trimmed, lower-cased message body if it can't tokenize
+// (e.g. an unterminated quote), so a malformed message just fails the flow
+// name lookup downstream rather than panicking here.
+func leadingKeyword(messageBody string) string {
+	tokens, err := cmd.Tokenize(strings.TrimSpace(messageBody))
+	if err != nil || len(tokens) == 0 {
+		return strings.ToLower(strings.TrimSpace(messageBody))
+	}
+	return strings.ToLower(strings.Trim(tokens[0], "?!."))
+}
+
+// splitUpdateField pulls the field name and raw value text out of a trimmed
+// "update field: value" line, preserving the original case of everything
+// after the colon.
+func splitUpdateField(line string) (field, value string, ok bool) {
+	rest := strings.TrimSpace(line[len("update "):])
+	colon := strings.Index(rest, ":")
+	if colon < 0 {
+		return "", "", false
+	}
+	return strings.TrimSpace(rest[:colon]), strings.TrimSpace(rest[colon+1:]), true
+}
+
+// ParseUpdateOrderCommand turns "update order 9:12, 10: 1x3, 3x2, 2x1, 6:5"
+// into one MenuIndication per item. Items are comma-separated, but an
+// item's own option pairs ("1x3, 3x2, ...") are comma-separated too, so a
+// bare regexp split can't tell item boundaries from option boundaries. A
+// token starting a new item always has a colon ("9:12", "10:"); a token
+// that's a bare "MxK" option pair belongs to whichever item most recently
+// opened, so it's folded back into that group instead.
 func ParseUpdateOrderCommand(commandText string) ([]MenuIndication, error) {
-	// Remove "update order" prefix
 	commandText = strings.TrimPrefix(commandText, "update order")
 	commandText = strings.TrimPrefix(commandText, ":")
 	commandText = strings.TrimSpace(commandText)
-	commandText = strings.Replace(commandText, " ", "", 1)
-
-	// Regular expression to match "ItemMenuNum: ItemAmount" pairs
-	re := regexp.MustCompile(`\b\d+:\s*(?:\d+x\d+(?:,\s*)?)+`)
 
-	// Find all matches in the commandText
-	matches := re.FindAllString(commandText, -1)
-
-	// Remove matched parts from the commandText
-	for k, match := range matches {
-		trimmedMatch := strings.TrimSpace(match)
-		trimmedMatch = strings.TrimSuffix(trimmedMatch, ",")
-		matches[k] = trimmedMatch
-		commandText = strings.Replace(commandText, match, "", 1)
+	var groups []string
+	for _, raw := range strings.Split(commandText, ",") {
+		tok := strings.TrimSpace(raw)
+		if tok == "" {
+			continue
+		}
+		if strings.Contains(tok, ":") || len(groups) == 0 {
+			groups = append(groups, tok)
+		} else {
+			groups[len(groups)-1] += ", " + tok
+		}
 	}
 
-	// Trim any remaining whitespace or commas
-	commandText = strings.Trim(commandText, ",")
-
-	// Initialize slice to store OrderItems
 	var orderItems []MenuIndication
-
-	// Process each match
-	for _, match := range matches {
-		orderItem, err := parseOrderItem(match)
+	for _, group := range groups {
+		orderItem, err := parseOrderItem(group)
 		if err != nil {
 			return nil, err
 		}
 		orderItems = append(orderItems, orderItem)
 	}
 
-	// Process remaining commandText for simple "ItemMenuNum: ItemAmount" pairs
-	if commandText != "" {
-		remainingItems := strings.Split(commandText, ",")
-		for _, item := range remainingItems {
-			item = strings.TrimSpace(item)
-			if item == "" {
-				continue
-			}
-			orderItem, err := parseOrderItem(item)
-			if err != nil {
-				return nil, err
-			}
-			orderItems = append(orderItems, orderItem)
-		}
-	}
-
 	return orderItems, nil
 }
 
@@ -0,0 +1,65 @@
+package whatsappbot
+
+import "testing"
+
+func TestParseUpdateOrderCommandSimplePairs(t *testing.T) {
+	items, err := ParseUpdateOrderCommand("update order: 9:12, 6:5")
+	if err != nil {
+		t.Fatalf("ParseUpdateOrderCommand returned error: %v", err)
+	}
+	want := []MenuIndication{
+		{ItemMenuNum: 9, ItemAmount: "12"},
+		{ItemMenuNum: 6, ItemAmount: "5"},
+	}
+	assertMenuIndicationsEqual(t, items, want)
+}
+
+func TestParseUpdateOrderCommandWithOptionGroups(t *testing.T) {
+	items, err := ParseUpdateOrderCommand("update order: 9:12, 10: 1x3, 3x2, 2x1, 6:5")
+	if err != nil {
+		t.Fatalf("ParseUpdateOrderCommand returned error: %v", err)
+	}
+	want := []MenuIndication{
+		{ItemMenuNum: 9, ItemAmount: "12"},
+		{ItemMenuNum: 10, ItemAmount: "1x3, 3x2, 2x1"},
+		{ItemMenuNum: 6, ItemAmount: "5"},
+	}
+	assertMenuIndicationsEqual(t, items, want)
+}
+
+func TestParseUpdateOrderCommandRejectsMalformedItem(t *testing.T) {
+	if _, err := ParseUpdateOrderCommand("update order: not-an-item"); err == nil {
+		t.Fatal("expected an error for a malformed item")
+	}
+}
+
+func TestSplitUpdateFieldPreservesValueCase(t *testing.T) {
+	field, value, ok := splitUpdateField("update email: Jane@Example.com")
+	if !ok {
+		t.Fatal("expected splitUpdateField to succeed")
+	}
+	if field != "email" {
+		t.Errorf("field = %q, want %q", field, "email")
+	}
+	if value != "Jane@Example.com" {
+		t.Errorf("value = %q, want %q (emails must keep their case)", value, "Jane@Example.com")
+	}
+}
+
+func TestSplitUpdateFieldRejectsMissingColon(t *testing.T) {
+	if _, _, ok := splitUpdateField("update email"); ok {
+		t.Fatal("expected splitUpdateField to reject a line with no colon")
+	}
+}
+
+func assertMenuIndicationsEqual(t *testing.T, got, want []MenuIndication) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d items %+v, want %d items %+v", len(got), got, len(want), want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("item %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}